@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// authTimeout задает время, которое клиент получает на ответ CHALLENGE/AUTH до разрыва
+// соединения.
+const authTimeout = 10 * time.Second
+
+// CHALLENGE и AUTH дополняют словарь команд протокола для рукопожатия аутентификации.
+const (
+	CHALLENGE = "CHALLENGE"
+	AUTH      = "AUTH"
+)
+
+// authenticate выполняет рукопожатие аутентификации перед тем, как соединение попадет в общий
+// командный цикл: сервер отправляет CHALLENGE <nonce>, а клиент должен ответить
+// AUTH <id> <hmac-sha256(secret, nonce||id)> в пределах authTimeout. Возвращает
+// подтвержденный id или ошибку, если клиент не ответил вовремя, назвал неизвестный id или
+// подпись не совпала.
+func (srv *Server) authenticate(conn net.Conn, addr string, reader *bufio.Reader) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	nonceHex := hex.EncodeToString(nonce)
+
+	if err := conn.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+		return "", err
+	}
+	if err := Send(srv.writeTimeout(), addr, conn, CHALLENGE, nonceHex); err != nil {
+		return "", err
+	}
+
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	message = strings.TrimSpace(message)
+	splits := strings.SplitN(message, " ", 2)
+	if strings.ToUpper(splits[0]) != AUTH || len(splits) < 2 {
+		Send(srv.writeTimeout(), addr, conn, ERROR, AUTH, "expected AUTH")
+		return "", errors.New("locator: expected AUTH")
+	}
+	fields := strings.Fields(splits[1])
+	if len(fields) != 2 {
+		Send(srv.writeTimeout(), addr, conn, ERROR, AUTH, "malformed")
+		return "", errors.New("locator: malformed AUTH")
+	}
+	id, mac := fields[0], fields[1]
+
+	secret, ok := srv.Secret(id)
+	if !ok {
+		Send(srv.writeTimeout(), addr, conn, ERROR, AUTH, id, "unknown id")
+		return "", fmt.Errorf("locator: unknown id %q", id)
+	}
+	if !hmac.Equal([]byte(mac), []byte(hmacHex(secret, nonce, id))) {
+		Send(srv.writeTimeout(), addr, conn, ERROR, AUTH, id, "invalid signature")
+		return "", fmt.Errorf("locator: invalid signature for %q", id)
+	}
+	if err := Send(srv.writeTimeout(), addr, conn, OK, AUTH, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// hmacHex вычисляет hex-представление HMAC-SHA256(secret, nonce||id) — подпись, которую должен
+// предъявить клиент в ответ на CHALLENGE.
+func hmacHex(secret, nonce []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config описывает настройки сервера, загружаемые из файла (JSON или YAML) или из переменной
+// окружения LOCATOR_CONFIG.
+type Config struct {
+	TCPAddr  string `json:"tcp_addr,omitempty" yaml:"tcp_addr,omitempty"`   // адрес для ListenAndServe
+	TLSAddr  string `json:"tls_addr,omitempty" yaml:"tls_addr,omitempty"`   // адрес для ListenAndServeTLS
+	UDPAddr  string `json:"udp_addr,omitempty" yaml:"udp_addr,omitempty"`   // адрес для ListenAndServePacket
+	DTLSAddr string `json:"dtls_addr,omitempty" yaml:"dtls_addr,omitempty"` // адрес для ListenAndServeDTLS
+
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"` // путь к сертификату TLS/DTLS
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file,omitempty"`   // путь к приватному ключу TLS/DTLS
+
+	ReadTimeout  time.Duration `json:"read_timeout,omitempty" yaml:"read_timeout,omitempty"`   // дедлайн чтения (активность клиента)
+	WriteTimeout time.Duration `json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`  // дедлайн записи ответа
+	RelayTimeout time.Duration `json:"relay_timeout,omitempty" yaml:"relay_timeout,omitempty"`  // дедлайн записи при пересылке TO
+
+	MaxHeaderLength  int   `json:"max_header_length,omitempty" yaml:"max_header_length,omitempty"`   // максимальная длина строки команды
+	MaxPayloadLength int64 `json:"max_payload_length,omitempty" yaml:"max_payload_length,omitempty"` // ограничение размера полезной нагрузки TO
+
+	// SessionRequestTimeout задает время ожидания SESSION_ACCEPT/SESSION_REJECT от peer_id.
+	SessionRequestTimeout time.Duration `json:"session_request_timeout,omitempty" yaml:"session_request_timeout,omitempty"`
+	// RelayBufferSize задает размер буфера копирования в активной SESSION-сессии.
+	RelayBufferSize int `json:"relay_buffer_size,omitempty" yaml:"relay_buffer_size,omitempty"`
+
+	// Secrets хранит общий секрет на каждый id, которым клиент должен подтвердить владение при
+	// CONNECT (см. ACL.authenticate). Если карта пуста, аутентификация не требуется.
+	Secrets map[string]string `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+
+	// ACL задает разрешенные и запрещенные цели TO/INFO для каждого аутентифицированного id.
+	ACL map[string]ACLRule `json:"acl,omitempty" yaml:"acl,omitempty"`
+}
+
+// ACLRule описывает, к каким id разрешено (или запрещено) обращаться через TO/INFO. Шаблоны
+// сопоставляются как обычные файловые маски (path.Match): "partner-*", "?"  и т.п.
+type ACLRule struct {
+	AllowTo []string `json:"allow_to,omitempty" yaml:"allow_to,omitempty"` // разрешенные цели; пусто — разрешено все, кроме deny_to
+	DenyTo  []string `json:"deny_to,omitempty" yaml:"deny_to,omitempty"`   // запрещенные цели; проверяются раньше allow_to
+}
+
+// allowedTo сообщает, разрешено ли id обращаться к target через TO/INFO. Если правил для id не
+// задано вовсе, разрешено все (сохраняет обратную совместимость для клиентов без ACL).
+func (c *Config) allowedTo(id, target string) bool {
+	rule, ok := c.ACL[id]
+	if !ok {
+		return true
+	}
+	for _, pattern := range rule.DenyTo {
+		if matched, _ := gopath.Match(pattern, target); matched {
+			return false
+		}
+	}
+	if len(rule.AllowTo) == 0 {
+		return true
+	}
+	for _, pattern := range rule.AllowTo {
+		if matched, _ := gopath.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultConfig возвращает конфигурацию со значениями по умолчанию, совпадающими с теми, что
+// ранее были зашиты в коде, включая пути к cert.pem/key.pem рядом с исполняемым файлом.
+func DefaultConfig() *Config {
+	var certDir = filepath.Dir(os.Args[0])
+	return &Config{
+		TCPAddr:  ":9000",
+		TLSAddr:  ":9001",
+		UDPAddr:  ":9000",
+		DTLSAddr: ":9002",
+
+		CertFile: filepath.Join(certDir, "cert.pem"),
+		KeyFile:  filepath.Join(certDir, "key.pem"),
+
+		ReadTimeout:  2 * time.Minute,
+		WriteTimeout: 5 * time.Second,
+		RelayTimeout: 30 * time.Second,
+
+		MaxHeaderLength:  256,
+		MaxPayloadLength: 10 << 20, // 10 МБ
+
+		SessionRequestTimeout: 30 * time.Second,
+		RelayBufferSize:       32 << 10, // 32 КБ
+	}
+}
+
+// LoadConfig читает конфигурацию из файла по указанному пути. Формат определяется по
+// расширению: .yml/.yaml разбирается как YAML, все остальное — как JSON. Поля, отсутствующие в
+// файле, остаются равны значениям по умолчанию.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, config)
+	default:
+		err = json.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ConfigFromEnv загружает конфигурацию из файла, путь к которому указан в переменной окружения
+// LOCATOR_CONFIG. Если переменная не задана, возвращает конфигурацию по умолчанию.
+func ConfigFromEnv() (*Config, error) {
+	path := os.Getenv("LOCATOR_CONFIG")
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	return LoadConfig(path)
+}
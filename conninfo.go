@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -11,14 +12,17 @@ import (
 // ConnInfo описывает информацию о соединении.
 type ConnInfo struct {
 	id      string
-	addr    string    // IP-адрес и порт соединения
-	addr2   string    // передающийся адрес и порт
-	updated time.Time // дата и время последнего обновления информации
-	status  string    // строка со статусом
-	conn    net.Conn  // сокетное соединение
+	addr    string       // IP-адрес и порт соединения
+	addr2   string       // передающийся адрес и порт
+	updated time.Time    // дата и время последнего обновления информации
+	status  string       // строка со статусом
+	conn    net.Conn     // потоковое соединение (TCP/TLS/DTLS)
+	pc      net.PacketConn // общий датаграммный сокет, если клиент зарегистрирован по UDP
+	raddr   net.Addr       // адрес клиента в рамках pc
 }
 
-// NewConnInfo возвращает новую информацию о соединении.
+// NewConnInfo возвращает новую информацию о соединении, установленном поверх net.Conn
+// (TCP, TLS или DTLS).
 func NewConnInfo(conn net.Conn, id, addr, addr2 string) *ConnInfo {
 	if addr2 == "" {
 		addr2 = "0.0.0.0:0"
@@ -33,7 +37,24 @@ func NewConnInfo(conn net.Conn, id, addr, addr2 string) *ConnInfo {
 	return ci
 }
 
-// Close закрывает сокетное соединение.
+// NewConnInfoPacket возвращает новую информацию о соединении, зарегистрированном по UDP: вместо
+// отдельного net.Conn клиент идентифицируется адресом raddr в рамках общего сокета pc.
+func NewConnInfoPacket(pc net.PacketConn, raddr net.Addr, id, addr, addr2 string) *ConnInfo {
+	if addr2 == "" {
+		addr2 = "0.0.0.0:0"
+	}
+	var ci = &ConnInfo{
+		id:      id,
+		addr:    addr,
+		addr2:   addr2,
+		pc:      pc,
+		raddr:   raddr,
+		updated: time.Now().UTC(),
+	}
+	return ci
+}
+
+// Close закрывает сокетное соединение. Для датаграммных регистраций общий сокет не закрывается.
 func (ci *ConnInfo) Close() error {
 	if ci.conn != nil {
 		return ci.conn.Close()
@@ -41,6 +62,21 @@ func (ci *ConnInfo) Close() error {
 	return nil
 }
 
+// send отправляет клиенту данные независимо от типа транспорта: потокового (net.Conn) или
+// датаграммного (net.PacketConn и адрес клиента в рамках него).
+func (ci *ConnInfo) send(payload []byte) error {
+	switch {
+	case ci.conn != nil:
+		_, err := ci.conn.Write(payload)
+		return err
+	case ci.pc != nil:
+		_, err := ci.pc.WriteTo(payload, ci.raddr)
+		return err
+	default:
+		return errors.New("locator: connection has no transport")
+	}
+}
+
 // String возвращает строковое представление информации о соединении.
 func (ci *ConnInfo) String() string {
 	return fmt.Sprintf("%s %s %s %s", ci.addr, ci.addr2, ci.updated.UTC().Format(time.RFC3339), ci.status)
@@ -59,7 +95,9 @@ func (ci *ConnInfo) Update() {
 
 // List описывает список с информацией о соединениях.
 type List struct {
+	Logger      Logger               // leveled-логгер; если не задан, используется defaultLog
 	connections map[string]*ConnInfo // информация о всех соединениях
+	sessions    map[string]string    // id -> id партнера в активной SESSION-сессии
 	mu          sync.RWMutex
 }
 
@@ -67,19 +105,42 @@ type List struct {
 func NewList() *List {
 	return &List{
 		connections: make(map[string]*ConnInfo),
+		sessions:    make(map[string]string),
 	}
 }
 
+// log возвращает логгер списка: явно заданный через поле Logger или defaultLog, если он не
+// задан.
+func (l *List) log() Logger {
+	if l.Logger != nil {
+		return l.Logger
+	}
+	return defaultLog
+}
+
 // Add добавляет новую информацию о соединении.
 func (l *List) Add(conn net.Conn, id, addr, addr2 string) {
 	l.mu.Lock()
 	if info, ok := l.connections[id]; ok {
+		l.log().Info("replacing existing connection", "id", id, "remote_addr", addr)
 		info.Close()
 	}
 	l.connections[id] = NewConnInfo(conn, id, addr, addr2)
 	l.mu.Unlock()
 }
 
+// AddPacket регистрирует клиента, подключившегося по UDP: вместо отдельного net.Conn он
+// идентифицируется адресом raddr в рамках общего сокета pc.
+func (l *List) AddPacket(pc net.PacketConn, raddr net.Addr, id, addr, addr2 string) {
+	l.mu.Lock()
+	if info, ok := l.connections[id]; ok {
+		l.log().Info("replacing existing connection", "id", id, "remote_addr", addr)
+		info.Close()
+	}
+	l.connections[id] = NewConnInfoPacket(pc, raddr, id, addr, addr2)
+	l.mu.Unlock()
+}
+
 // SetStatus изменяет статусное сообщение соединения, если оно зарегистрировано с таким идентификатором.
 func (l *List) SetStatus(id, status string) {
 	l.mu.RLock()
@@ -99,13 +160,45 @@ func (l *List) Update(id string) {
 	l.mu.RUnlock()
 }
 
-// Remove удаляет информацию о соединении с указанным идентификатором.
+// Remove удаляет информацию о соединении с указанным идентификатором и, если id состоял в
+// активной SESSION-сессии, снимает пару и с партнера.
 func (l *List) Remove(id string) {
 	l.mu.Lock()
 	if info, ok := l.connections[id]; ok {
 		info.Close()
 		delete(l.connections, id)
 	}
+	if partner, ok := l.sessions[id]; ok {
+		delete(l.sessions, id)
+		delete(l.sessions, partner)
+	}
+	l.mu.Unlock()
+}
+
+// SetSession отмечает id и partner как состоящие в активной full-duplex relay-сессии,
+// установленной командой SESSION.
+func (l *List) SetSession(id, partner string) {
+	l.mu.Lock()
+	l.sessions[id] = partner
+	l.mu.Unlock()
+}
+
+// Session возвращает id партнера, с которым id состоит в активной SESSION-сессии.
+func (l *List) Session(id string) (string, bool) {
+	l.mu.RLock()
+	partner, ok := l.sessions[id]
+	l.mu.RUnlock()
+	return partner, ok
+}
+
+// ClearSession снимает пару SESSION-сессии для id и, если она была установлена, для его
+// партнера тоже.
+func (l *List) ClearSession(id string) {
+	l.mu.Lock()
+	if partner, ok := l.sessions[id]; ok {
+		delete(l.sessions, id)
+		delete(l.sessions, partner)
+	}
 	l.mu.Unlock()
 }
 
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logger описывает минимальный интерфейс leveled-логгера с структурированными полями
+// (чередующиеся пары ключ-значение, как в log/slog). За ним может стоять как log/slog, так и
+// адаптер над logrus или zap.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// defaultLog используется всеми компонентами, для которых явно не задан свой Logger.
+var defaultLog Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// Подсистемы, трассировку которых можно включать по отдельности через LOCATOR_TRACE, по
+// аналогии с переменной STTRACE в syncthing.
+var (
+	debugNet   bool // прием соединений и работа слушателей
+	debugCmd   bool // разбор и диспетчеризация команд
+	debugRelay bool // пересылка данных по TO/SESSION
+	debugConn  bool // жизненный цикл соединения (подключение/отключение, keepalive)
+)
+
+func init() {
+	parseTrace(os.Getenv("LOCATOR_TRACE"))
+}
+
+// parseTrace разбирает LOCATOR_TRACE: список имен подсистем через запятую (net, cmd, relay,
+// conn), либо all, включающий трассировку всех подсистем сразу.
+func parseTrace(value string) {
+	if value == "" {
+		return
+	}
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "all":
+			debugNet, debugCmd, debugRelay, debugConn = true, true, true, true
+		case "net":
+			debugNet = true
+		case "cmd":
+			debugCmd = true
+		case "relay":
+			debugRelay = true
+		case "conn":
+			debugConn = true
+		}
+	}
+}
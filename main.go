@@ -1,23 +1,42 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
-	"path/filepath"
 )
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	configPath := flag.String("config", "", "путь к файлу конфигурации (JSON или YAML)")
+	flag.Parse()
+
+	var (
+		config *Config
+		err    error
+	)
+	if *configPath != "" {
+		config, err = LoadConfig(*configPath)
+	} else {
+		config, err = ConfigFromEnv()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var list = NewList() // инициализируем список соединений
 	go func() {
-		var server = NewServer(list)
-		var (
-			currentDir = filepath.Dir(os.Args[0])
-			cert       = filepath.Join(currentDir, "cert.pem")
-			key        = filepath.Join(currentDir, "key.pem")
-		)
-		log.Println(server.ListenAndServeTLS(cert, key))
+		var server = NewServer(list, config)
+		defaultLog.Error("tls server stopped", "err", server.ListenAndServeTLS("", ""))
+	}()
+	go func() {
+		var server = NewServer(list, config)
+		defaultLog.Error("udp server stopped", "err", server.ListenAndServePacket())
+	}()
+	go func() {
+		var server = NewServer(list, config)
+		defaultLog.Error("dtls server stopped", "err", server.ListenAndServeDTLS("", ""))
 	}()
-	var server = NewServer(list)
-	log.Fatal(server.ListenAndServe())
+	var server = NewServer(list, config)
+	defaultLog.Error("tcp server stopped", "err", server.ListenAndServe())
+	os.Exit(1)
 }
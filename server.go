@@ -2,71 +2,581 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pion/dtls/v2"
 )
 
-var timeout = time.Duration(2 * time.Minute)
+// cookieSize задает размер анти-спуфинг cookie, выдаваемого UDP-клиенту до регистрации.
+const cookieSize = 16
+
+// pendingCookie хранит cookie, выданный адресу, который еще не подтвердил его повторной
+// отправкой в CONNECT.
+type pendingCookie struct {
+	id     string
+	cookie []byte
+}
+
+// pendingUDPAuth хранит CHALLENGE, выданный адресу, подтвердившему cookie, пока сервер не
+// получит от него AUTH с верной HMAC-подписью (см. connectPacket и servPacket).
+type pendingUDPAuth struct {
+	id    string
+	addr2 string
+	nonce []byte
+}
+
+// tunables хранит горячие параметры сервера (тайм-ауты и лимиты), которые Reload может менять на
+// лету. Поля читаются и пишутся через atomic, потому что к ним обращаются одновременно множество
+// goroutine-обработчиков соединений и, возможно, Reload: раньше те же значения лежали в пакетных
+// переменных, из-за чего их чтение в servConn было гонкой, а два *Server (TCP- и TLS-листенеры в
+// main.go) незаметно делили и перезаписывали одно и то же глобальное состояние.
+type tunables struct {
+	readTimeout           atomic.Int64 // time.Duration; дедлайн чтения (активность клиента)
+	writeTimeout          atomic.Int64 // time.Duration; дедлайн записи ответа
+	relayTimeout          atomic.Int64 // time.Duration; дедлайн записи при пересылке TO
+	maxHeaderLength       atomic.Int64 // максимальная длина строки команды
+	maxPayloadLength      atomic.Int64 // ограничение размера полезной нагрузки TO
+	sessionRequestTimeout atomic.Int64 // time.Duration; время ожидания SESSION_ACCEPT/SESSION_REJECT
+	relayBufferSize       atomic.Int64 // размер буфера копирования в активной SESSION-сессии
+}
 
 // Server описывает серверные подключения клиентов.
 type Server struct {
-	Addr        string // TCP-адрес и порт сервера
-	connections *List  // информация об установленных соединениях
+	Addr   string // TCP-адрес и порт сервера
+	Logger Logger // leveled-логгер; если не задан, используется defaultLog
+
+	// Secret возвращает общий секрет клиента по его id для рукопожатия CHALLENGE/AUTH; если
+	// равен nil, аутентификация при CONNECT не требуется. По умолчанию заполняется из
+	// config.Secrets, но может быть заменен, например, на обращение к внешнему хранилищу.
+	Secret func(id string) ([]byte, bool)
+
+	connections *List            // информация об установленных соединениях
+	config      *Config          // настройки сервера; может заменяться через Reload, читается под connections.mu
+	cert        *tls.Certificate // текущий сертификат для TLS/DTLS, меняется через Reload
+	cfg         tunables         // горячие тайм-ауты и лимиты, меняются через Reload
+
+	udpMu   sync.Mutex                 // защищает cookies, udpAuth и udpIDs
+	cookies map[string]*pendingCookie  // выданные, но еще не подтвержденные cookie по адресу
+	udpAuth map[string]*pendingUDPAuth // выданные, но еще не подтвержденные AUTH по адресу
+	udpIDs  map[string]string          // адрес -> id для зарегистрированных UDP-клиентов
+
+	sessionMu      sync.Mutex                 // защищает sessionPending
+	sessionPending map[string]*sessionRequest // id инициатора -> его ожидающий ответа запрос SESSION
+}
+
+// readTimeout возвращает текущий дедлайн чтения (активность клиента).
+func (srv *Server) readTimeout() time.Duration { return time.Duration(srv.cfg.readTimeout.Load()) }
+
+// writeTimeout возвращает текущий дедлайн записи ответа.
+func (srv *Server) writeTimeout() time.Duration { return time.Duration(srv.cfg.writeTimeout.Load()) }
+
+// relayTimeout возвращает текущий дедлайн записи при пересылке TO.
+func (srv *Server) relayTimeout() time.Duration { return time.Duration(srv.cfg.relayTimeout.Load()) }
+
+// maxHeaderLength возвращает текущую максимальную длину строки команды.
+func (srv *Server) maxHeaderLength() int { return int(srv.cfg.maxHeaderLength.Load()) }
+
+// maxPayloadLength возвращает текущее ограничение размера полезной нагрузки TO.
+func (srv *Server) maxPayloadLength() int64 { return srv.cfg.maxPayloadLength.Load() }
+
+// sessionRequestTimeout возвращает текущее время ожидания SESSION_ACCEPT/SESSION_REJECT от peer_id.
+func (srv *Server) sessionRequestTimeout() time.Duration {
+	return time.Duration(srv.cfg.sessionRequestTimeout.Load())
 }
 
-func NewServer(connections *List) *Server {
+// relayBufferSize возвращает текущий размер буфера копирования в активной SESSION-сессии.
+func (srv *Server) relayBufferSize() int { return int(srv.cfg.relayBufferSize.Load()) }
+
+// NewServer возвращает новый сервер с указанным хранилищем соединений и конфигурацией. Если
+// connections равен nil, создается новый пустой List; если config равен nil, используется
+// DefaultConfig.
+func NewServer(connections *List, config *Config) *Server {
 	if connections == nil {
 		connections = NewList() // инициализируем хранилище информации о соединениях
 	}
-	return &Server{
-		connections: connections,
+	if config == nil {
+		config = DefaultConfig()
+	}
+	srv := &Server{
+		connections:    connections,
+		config:         config,
+		cookies:        make(map[string]*pendingCookie),
+		udpAuth:        make(map[string]*pendingUDPAuth),
+		udpIDs:         make(map[string]string),
+		sessionPending: make(map[string]*sessionRequest),
+	}
+	if len(config.Secrets) > 0 {
+		srv.Secret = func(id string) ([]byte, bool) {
+			secret, ok := config.Secrets[id]
+			return []byte(secret), ok
+		}
+	}
+	srv.applyConfig(config)
+	return srv
+}
+
+// log возвращает логгер сервера: явно заданный через поле Logger или defaultLog, если он не
+// задан.
+func (srv *Server) log() Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return defaultLog
+}
+
+// SetLogger задает логгер сервера и пробрасывает его в хранилище соединений, чтобы события
+// жизненного цикла клиентов тоже попадали в тот же бэкенд.
+func (srv *Server) SetLogger(logger Logger) {
+	srv.Logger = logger
+	srv.connections.Logger = logger
+}
+
+// applyConfig переносит тайм-ауты и лимиты из config в srv.cfg, откуда их атомарно читают
+// обработчики соединений.
+func (srv *Server) applyConfig(config *Config) {
+	srv.cfg.readTimeout.Store(int64(config.ReadTimeout))
+	srv.cfg.writeTimeout.Store(int64(config.WriteTimeout))
+	srv.cfg.relayTimeout.Store(int64(config.RelayTimeout))
+	srv.cfg.maxHeaderLength.Store(int64(config.MaxHeaderLength))
+	srv.cfg.maxPayloadLength.Store(config.MaxPayloadLength)
+	if config.SessionRequestTimeout > 0 {
+		srv.cfg.sessionRequestTimeout.Store(int64(config.SessionRequestTimeout))
+	}
+	if config.RelayBufferSize > 0 {
+		srv.cfg.relayBufferSize.Store(int64(config.RelayBufferSize))
 	}
 }
 
-// ListenAndServe запускает сервер. Если адрес сервера не указан, то используется порт :9000
+// getCertificate возвращает текущий TLS/DTLS-сертификат сервера. Вынесено в отдельный метод,
+// чтобы Reload мог заменить сертификат на лету, не пересоздавая слушатель.
+func (srv *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	srv.connections.mu.RLock()
+	defer srv.connections.mu.RUnlock()
+	if srv.cert == nil {
+		return nil, errors.New("locator: no TLS certificate configured")
+	}
+	return srv.cert, nil
+}
+
+// activeConfig возвращает текущий *Config сервера, синхронизированно с его заменой в Reload
+// (которая берет ту же блокировку connections.mu).
+func (srv *Server) activeConfig() *Config {
+	srv.connections.mu.RLock()
+	defer srv.connections.mu.RUnlock()
+	return srv.config
+}
+
+// Reload атомарно заменяет тайм-ауты, лимиты и TLS-сертификат сервера на значения из нового
+// конфига, не разрывая уже установленные соединения. Позволяет ротировать сертификат на
+// работающем relay-сервере.
+func (srv *Server) Reload(config *Config) error {
+	var cert *tls.Certificate
+	if config.CertFile != "" && config.KeyFile != "" {
+		loaded, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &loaded
+	}
+
+	srv.connections.mu.Lock()
+	defer srv.connections.mu.Unlock()
+	srv.applyConfig(config)
+	srv.config = config
+	if cert != nil {
+		srv.cert = cert
+	}
+	return nil
+}
+
+// ListenAndServe запускает сервер. Если адрес сервера не указан явно через Addr, используется
+// config.TCPAddr (по умолчанию :9000). Адрес :0 означает случайный порт; после успешного
+// Listen в Addr записывается фактически занятый адрес, который можно прочитать для тестов и
+// оркестрации.
 func (srv *Server) ListenAndServe() error {
 	if srv.Addr == "" {
-		srv.Addr = ":9000"
+		srv.Addr = srv.config.TCPAddr
 	}
 	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return err
 	}
+	srv.Addr = ln.Addr().String()
 	return srv.Serve(ln)
 }
 
-// ListenAndServeTLS запускает TLS-версию сервера. Если не указан адрес сервера, то используется
-// порт :9001
+// ListenAndServeTLS запускает TLS-версию сервера. Если не указан адрес сервера, используется
+// config.TLSAddr (по умолчанию :9001); путь к сертификату и ключу, если не переданы явно,
+// берутся из config.CertFile/config.KeyFile.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if srv.Addr == "" {
-		srv.Addr = ":9001"
+		srv.Addr = srv.config.TLSAddr
 	}
-	config := &tls.Config{}
-
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	if certFile == "" {
+		certFile = srv.config.CertFile
+	}
+	if keyFile == "" {
+		keyFile = srv.config.KeyFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	srv.connections.mu.Lock()
+	srv.cert = &cert
+	srv.connections.mu.Unlock()
 
 	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return err
 	}
+	srv.Addr = ln.Addr().String()
 
-	tlsListener := tls.NewListener(ln, config)
+	tlsListener := tls.NewListener(ln, &tls.Config{GetCertificate: srv.getCertificate})
 	return srv.Serve(tlsListener)
 }
 
+// ListenAndServeDTLS запускает DTLS-версию сервера (тот же протокол поверх шифрованного UDP).
+// Если не указан адрес сервера, используется config.DTLSAddr (по умолчанию :9002). Поскольку
+// DTLS выполняет рукопожатие на уровне сессии, принятое соединение ведет себя как обычный
+// net.Conn, и дальнейшая обработка идет через тот же Serve/servConn, что и для TCP.
+func (srv *Server) ListenAndServeDTLS(certFile, keyFile string) error {
+	if srv.Addr == "" {
+		srv.Addr = srv.config.DTLSAddr
+	}
+	if certFile == "" {
+		certFile = srv.config.CertFile
+	}
+	if keyFile == "" {
+		keyFile = srv.config.KeyFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.connections.mu.Lock()
+	srv.cert = &cert
+	srv.connections.mu.Unlock()
+
+	laddr, err := net.ResolveUDPAddr("udp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	ln, err := dtls.Listen("udp", laddr, &dtls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	srv.Addr = ln.Addr().String()
+	return srv.Serve(ln)
+}
+
+// ListenAndServePacket запускает датаграммную (UDP) версию сервера, позволяющую клиентам за
+// NAT поддерживать регистрацию через единственный UDP-сокет вместо долгоживущей TCP-сессии.
+// Если не указан адрес сервера, используется config.UDPAddr (по умолчанию :9000).
+func (srv *Server) ListenAndServePacket() error {
+	if srv.Addr == "" {
+		srv.Addr = srv.config.UDPAddr
+	}
+	pc, err := net.ListenPacket("udp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.Addr = pc.LocalAddr().String()
+	return srv.ServePacket(pc)
+}
+
+// ServePacket читает входящие датаграммы и обрабатывает каждую в отдельном потоке.
+func (srv *Server) ServePacket(pc net.PacketConn) error {
+	srv.log().Info("listening", "transport", "udp", "addr", srv.Addr)
+	if srv.connections == nil {
+		srv.connections = NewList() // инициализируем хранилище информации о соединениях
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		go srv.servPacket(pc, raddr, data)
+	}
+}
+
+// sendPacket отправляет клиенту ответ с тем же 4-байтным префиксом длины, что используется для
+// входящих команд.
+func sendPacket(pc net.PacketConn, raddr net.Addr, params ...string) error {
+	msg := strings.Join(params, " ") + "\n"
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(4+len(msg)))
+	buf.WriteString(msg)
+	if debugNet {
+		defaultLog.Debug("send", "remote_addr", raddr.String(), "transport", "udp", "msg", msg)
+	}
+	_, err := pc.WriteTo(buf.Bytes(), raddr)
+	return err
+}
+
+// servPacket обрабатывает одну датаграмму. Каждый запрос оформлен как 4-байтный префикс длины
+// (little-endian, включая сам префикс) и текстовая команда, как и в TCP-версии протокола; для
+// TO внутри того же кадра следует вложенный заголовок длины и бинарная полезная нагрузка по
+// аналогии с потоковой версией.
+//
+// Поскольку у UDP нет этапа установления соединения, первый CONNECT с нового адреса не
+// регистрирует клиента, а лишь возвращает случайный 16-байтный cookie (аналог DTLS
+// HelloVerifyRequest). Если сервер сконфигурирован с общими секретами (srv.Secret != nil), после
+// подтверждения cookie клиент получает CHALLENGE и регистрируется только после AUTH с верной
+// HMAC-подписью (см. connectPacket и authPacket) — точно так же, как TCP-соединение не может
+// зарегистрировать id без прохождения CHALLENGE/AUTH в authenticate.
+func (srv *Server) servPacket(pc net.PacketConn, raddr net.Addr, data []byte) {
+	addr := raddr.String()
+	if len(data) < 4 {
+		return // кадр слишком короткий, чтобы содержать префикс длины
+	}
+	var length int32
+	binary.Read(bytes.NewReader(data[:4]), binary.LittleEndian, &length)
+	if length < 4 || int(length) > len(data) {
+		return // некорректная длина кадра
+	}
+	body := data[4:length]
+	var line string
+	var rest []byte
+	if idx := bytes.IndexByte(body, '\n'); idx >= 0 {
+		line = strings.TrimSpace(string(body[:idx]))
+		rest = body[idx+1:]
+	} else {
+		line = strings.TrimSpace(string(body))
+	}
+	if len(line) > srv.maxHeaderLength() {
+		return // игнорируем слишком длинные заголовки
+	}
+	if debugCmd {
+		srv.log().Debug("recv", "remote_addr", addr, "transport", "udp", "msg", line)
+	}
+	splits := strings.SplitN(line, " ", 2)
+	cmd := strings.ToUpper(splits[0])
+	var param string
+	if len(splits) > 1 {
+		param = strings.TrimSpace(splits[1])
+	}
+	if cmd == CONNECT {
+		srv.connectPacket(pc, raddr, addr, param)
+		return
+	}
+	if cmd == AUTH {
+		srv.authPacket(pc, raddr, addr, param)
+		return
+	}
+	srv.udpMu.Lock()
+	id, ok := srv.udpIDs[addr]
+	srv.udpMu.Unlock()
+	if !ok {
+		sendPacket(pc, raddr, ERROR, cmd, "not connected")
+		return
+	}
+	srv.connections.Update(id)
+	switch cmd {
+	case STATUS:
+		srv.connections.SetStatus(id, param)
+		sendPacket(pc, raddr, OK, cmd, param)
+	case INFO:
+		if srv.Secret != nil && !srv.activeConfig().allowedTo(id, param) {
+			sendPacket(pc, raddr, ERROR, cmd, param, "forbidden")
+			return
+		}
+		info := srv.connections.Info(param)
+		if info == nil || time.Since(info.updated) >= srv.readTimeout() {
+			sendPacket(pc, raddr, ERROR, cmd, param, "not found")
+			return
+		}
+		sendPacket(pc, raddr, OK, cmd, param, info.String())
+	case PING:
+		sendPacket(pc, raddr, OK, cmd, param)
+	case DISCONNECT:
+		sendPacket(pc, raddr, OK, cmd)
+		srv.udpMu.Lock()
+		delete(srv.udpIDs, addr)
+		srv.udpMu.Unlock()
+		srv.connections.Remove(id)
+	case TO:
+		srv.toPacket(pc, raddr, id, param, rest)
+	default:
+		// неизвестная команда, игнорируем
+	}
+}
+
+// connectPacket обрабатывает CONNECT, пришедший по UDP, включая анти-спуфинг рукопожатие и, если
+// сервер сконфигурирован с общими секретами, запуск рукопожатия CHALLENGE/AUTH (см. authPacket) —
+// регистрация в любом случае откладывается до его успешного завершения.
+func (srv *Server) connectPacket(pc net.PacketConn, raddr net.Addr, addr, param string) {
+	fields := strings.Fields(param)
+	if len(fields) == 0 {
+		sendPacket(pc, raddr, ERROR, CONNECT, "empty id")
+		return
+	}
+	id := fields[0]
+
+	srv.udpMu.Lock()
+	pending, ok := srv.cookies[addr]
+	srv.udpMu.Unlock()
+	if ok && pending.id == id && len(fields) >= 2 && fields[len(fields)-1] == hex.EncodeToString(pending.cookie) {
+		var addr2 string
+		if len(fields) > 2 {
+			addr2 = fields[1]
+		}
+		srv.udpMu.Lock()
+		delete(srv.cookies, addr)
+		srv.udpMu.Unlock()
+		if srv.Secret == nil {
+			srv.udpMu.Lock()
+			srv.udpIDs[addr] = id
+			srv.udpMu.Unlock()
+			srv.connections.AddPacket(pc, raddr, id, addr, addr2)
+			sendPacket(pc, raddr, OK, CONNECT, id, addr)
+			srv.log().Info("connected", "id", id, "remote_addr", addr, "transport", "udp")
+			if debugConn {
+				srv.log().Debug("connections", "ids", srv.connections.List())
+			}
+			return
+		}
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			srv.log().Error("challenge generation failed", "remote_addr", addr, "err", err)
+			return
+		}
+		srv.udpMu.Lock()
+		srv.udpAuth[addr] = &pendingUDPAuth{id: id, addr2: addr2, nonce: nonce}
+		srv.udpMu.Unlock()
+		sendPacket(pc, raddr, CHALLENGE, hex.EncodeToString(nonce))
+		return
+	}
+
+	cookie := make([]byte, cookieSize)
+	if _, err := rand.Read(cookie); err != nil {
+		srv.log().Error("cookie generation failed", "remote_addr", addr, "err", err)
+		return
+	}
+	srv.udpMu.Lock()
+	srv.cookies[addr] = &pendingCookie{id: id, cookie: cookie}
+	srv.udpMu.Unlock()
+	sendPacket(pc, raddr, "COOKIE", hex.EncodeToString(cookie))
+}
+
+// authPacket обрабатывает AUTH, пришедший по UDP в ответ на CHALLENGE, выданный connectPacket
+// после подтверждения cookie. Сообщение должно иметь вид "AUTH <id> <hmac-sha256(secret,
+// nonce||id)>", где id совпадает с тем, что было заявлено в CONNECT, — так же, как AUTH
+// проверяется для TCP-соединений в authenticate.
+func (srv *Server) authPacket(pc net.PacketConn, raddr net.Addr, addr, param string) {
+	srv.udpMu.Lock()
+	pending, ok := srv.udpAuth[addr]
+	if ok {
+		delete(srv.udpAuth, addr)
+	}
+	srv.udpMu.Unlock()
+	if !ok {
+		sendPacket(pc, raddr, ERROR, AUTH, "no such request")
+		return
+	}
+	fields := strings.Fields(param)
+	if len(fields) != 2 || fields[0] != pending.id {
+		sendPacket(pc, raddr, ERROR, AUTH, pending.id, "malformed")
+		return
+	}
+	id, mac := fields[0], fields[1]
+	secret, ok := srv.Secret(id)
+	if !ok {
+		sendPacket(pc, raddr, ERROR, AUTH, id, "unknown id")
+		return
+	}
+	if !hmac.Equal([]byte(mac), []byte(hmacHex(secret, pending.nonce, id))) {
+		sendPacket(pc, raddr, ERROR, AUTH, id, "invalid signature")
+		return
+	}
+	srv.udpMu.Lock()
+	srv.udpIDs[addr] = id
+	srv.udpMu.Unlock()
+	srv.connections.AddPacket(pc, raddr, id, addr, pending.addr2)
+	sendPacket(pc, raddr, OK, AUTH, id)
+	srv.log().Info("connected", "id", id, "remote_addr", addr, "transport", "udp")
+	if debugConn {
+		srv.log().Debug("connections", "ids", srv.connections.List())
+	}
+}
+
+// toPacket пересылает датаграмму TO получателю независимо от того, по какому транспорту тот
+// зарегистрирован: заголовок и полезная нагрузка собираются целиком в памяти и передаются через
+// транспортно-независимый ConnInfo.send.
+func (srv *Server) toPacket(pc net.PacketConn, raddr net.Addr, id, param string, rest []byte) {
+	if param == "" {
+		sendPacket(pc, raddr, ERROR, TO, "empty TO")
+		return
+	}
+	if srv.Secret != nil && !srv.activeConfig().allowedTo(id, param) {
+		sendPacket(pc, raddr, ERROR, TO, param, "forbidden")
+		return
+	}
+	to := srv.connections.Info(param)
+	if to == nil || time.Since(to.updated) > srv.readTimeout() {
+		sendPacket(pc, raddr, ERROR, TO, param, "not connected")
+		return
+	}
+	if len(rest) < 4 {
+		sendPacket(pc, raddr, ERROR, TO, "missing payload length")
+		return
+	}
+	var length int32
+	binary.Read(bytes.NewReader(rest[:4]), binary.LittleEndian, &length)
+	if int(length) < 4 || int(length)-4 > len(rest)-4 {
+		sendPacket(pc, raddr, ERROR, TO, "bad payload length")
+		return
+	}
+	if int64(length)-4 > srv.maxPayloadLength() {
+		sendPacket(pc, raddr, ERROR, TO, "payload too large")
+		return
+	}
+	payload := rest[4:length]
+
+	var frame bytes.Buffer
+	frame.WriteString("FROM " + id + "\n")
+	binary.Write(&frame, binary.LittleEndian, int32(4+len(payload)))
+	frame.Write(payload)
+	wire := frame.Bytes()
+	if to.conn == nil {
+		// Получатель зарегистрирован по UDP/DTLS-PacketConn: в отличие от потокового net.Conn, его
+		// датаграммы разбираются по внешнему 4-байтному префиксу длины (см. servPacket/sendPacket),
+		// так что весь кадр нужно обернуть в такой же префикс, иначе получатель не сможет его
+		// разобрать вместе с остальными входящими датаграммами.
+		var outer bytes.Buffer
+		binary.Write(&outer, binary.LittleEndian, int32(4+frame.Len()))
+		outer.Write(frame.Bytes())
+		wire = outer.Bytes()
+	}
+	if err := to.send(wire); err != nil {
+		sendPacket(pc, raddr, ERROR, TO, err.Error())
+		srv.connections.Remove(param)
+		return
+	}
+	if debugRelay {
+		srv.log().Debug("relayed", "cmd", TO, "id", id, "peer_id", param, "bytes", len(payload))
+	}
+	sendPacket(pc, raddr, OK, TO, param)
+}
+
 // Serve принимает входящее соединение и запускает в отдельном потоке его обработку.
 func (srv *Server) Serve(l net.Listener) error {
-	log.Printf("Listen %s...", srv.Addr)
+	srv.log().Info("listening", "addr", srv.Addr)
 	if srv.connections == nil {
 		srv.connections = NewList() // инициализируем хранилище информации о соединениях
 	}
@@ -83,7 +593,7 @@ func (srv *Server) Serve(l net.Listener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("Accept error: %v; retrying in %v", err, tempDelay)
+				srv.log().Error("accept failed, retrying", "err", err, "delay", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -106,53 +616,181 @@ const (
 	OK         = "OK"
 	ERROR      = "ERROR"
 	TO         = "TO"
+
+	SESSION         = "SESSION"         // запрос на установление full-duplex relay-сессии с peer_id
+	SESSION_REQUEST = "SESSION_REQUEST" // уведомление peer_id о входящем запросе SESSION
+	SESSION_ACCEPT  = "SESSION_ACCEPT"  // peer_id подтверждает запрос на сессию
+	SESSION_REJECT  = "SESSION_REJECT"  // peer_id отклоняет запрос на сессию
+	// SESSION_CLOSE отменяет запрос SESSION, пока peer_id еще не ответил SESSION_ACCEPT/SESSION_REJECT.
+	// У уже установленной сессии парсинг команд не возобновляется: после SESSION/SESSION_ACCEPT
+	// сервер отдает reader целиком под релей байтов и больше не заглядывает в них, поэтому он не
+	// может отличить байт данных от управляющей последовательности без отдельного кадрирования,
+	// которое этот протокол не определяет. Активная сессия завершается только закрытием
+	// TCP-соединения одной из сторон (см. case SESSION / SESSION_ACCEPT ниже).
+	SESSION_CLOSE = "SESSION_CLOSE"
 )
 
-func Send(addr string, conn net.Conn, params ...string) error {
+// Send отправляет клиенту строку-команду с дедлайном записи writeTimeout (берется у вызывающего
+// *Server, так как он может быть разным для разных серверов и меняться через Reload).
+func Send(writeTimeout time.Duration, addr string, conn net.Conn, params ...string) error {
 	msg := strings.Join(params, " ") + "\n"
-	log.Printf("%s <- %s", addr, msg)
-	if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+	if debugNet {
+		defaultLog.Debug("send", "remote_addr", addr, "msg", msg)
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
 		return err
 	}
 	_, err := io.WriteString(conn, msg)
 	return err
 }
 
+// pingTimeout задает время ожидания ответного PONG на серверную keepalive-пробу.
+const pingTimeout = 10 * time.Second
+
+// TimeoutError возвращается пробой, если клиент не ответил PONG вовремя.
+type TimeoutError struct{}
+
+func (TimeoutError) Error() string { return "ping timeout" }
+
+// probe отправляет клиенту PING со случайным nonce и в отдельной горутине ждет ответа на
+// errChannel, который наполняется либо из reader-цикла servConn — любым полученным от клиента
+// сообщением, не только PONG, поскольку это само по себе уже доказывает, что соединение живо, —
+// либо из time.AfterFunc, если клиент не ответил вообще ничем за pingTimeout. probe не блокирует
+// вызывающую горутину: reader-цикл должен продолжать читать conn (и тем самым доставлять в
+// errChannel признак активности), пока проба ожидает ответа. Если проба не дождалась активности
+// вовремя или не смогла отправить сам PING, она сама закрывает conn — это приводит к ошибке в
+// текущем Read() reader-цикла и штатной очистке соединения через defer в servConn.
+func probe(srv *Server, id, addr string, conn net.Conn, pending map[string]chan error, mu *sync.Mutex) {
+	go func() {
+		buf := make([]byte, 8)
+		if _, err := rand.Read(buf); err != nil {
+			srv.log().Error("keepalive probe failed", "remote_addr", addr, "id", id, "err", err)
+			conn.Close()
+			return
+		}
+		nonce := hex.EncodeToString(buf)
+
+		errChannel := make(chan error, 1)
+		mu.Lock()
+		pending[nonce] = errChannel
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(pending, nonce)
+			mu.Unlock()
+		}()
+
+		if err := Send(srv.writeTimeout(), addr, conn, PING, nonce); err != nil {
+			srv.log().Error("keepalive probe failed", "remote_addr", addr, "id", id, "err", err)
+			conn.Close()
+			return
+		}
+		timer := time.AfterFunc(pingTimeout, func() {
+			select {
+			case errChannel <- TimeoutError{}:
+			default:
+			}
+		})
+		defer timer.Stop()
+		if err := <-errChannel; err != nil {
+			srv.log().Error("keepalive probe failed", "remote_addr", addr, "id", id, "err", err)
+			conn.Close()
+		}
+	}()
+}
+
+// sessionRequest описывает запрос SESSION, отправленный инициатором peer'у, пока тот не
+// подтвердил или не отклонил его.
+type sessionRequest struct {
+	peer  string    // id, от которого (и только от которого) ожидается SESSION_ACCEPT/SESSION_REJECT
+	resp  chan bool // true — peer принял сессию, false — отклонил или недоступен
+	ready chan struct{}
+	// ready закрывается инициатором ровно один раз — либо сразу после того, как он дописал "OK
+	// SESSION <peer>" в свой conn (успешно или нет), либо при отмене рандеву (инициатор не дождался
+	// SESSION_ACCEPT/SESSION_REJECT от peer'а и сам вышел по sessionRequestTimeout). Peer обязан
+	// дождаться закрытия ready, прежде чем начинать релей в сторону initiator.conn — иначе релей и
+	// этот Send гонятся за право писать в один и тот же net.Conn.
+	granted bool // true, если ready закрыт после успешной записи OK инициатором, а не по таймауту отмены
+}
+
 // servConn обрабатывает удаленное соединение.
 func (srv *Server) servConn(conn net.Conn) {
 	var (
-		reader = bufio.NewReader(conn)      // буфер для чтения команд
-		addr   = conn.RemoteAddr().String() // адрес удаленного сервера
-		id     string                       // уникальный идентификатор соединения
+		reader  = bufio.NewReader(conn)       // буфер для чтения команд
+		addr    = conn.RemoteAddr().String()  // адрес удаленного сервера
+		id      string                        // уникальный идентификатор соединения
+		pending = make(map[string]chan error) // nonce -> канал, ожидающий ответного PONG
+		pendMu  sync.Mutex                    // защищает pending
 	)
-	log.Printf("%s <- connected", addr) // выводим информацию об установленно соединении
+	srv.log().Info("connected", "remote_addr", addr)
+
+	// Если сервер сконфигурирован с общими секретами, соединение должно сперва пройти
+	// рукопожатие CHALLENGE/AUTH — без этого CONNECT не может зарегистрировать id, и
+	// неаутентифицированное соединение обрывается по истечении authTimeout.
+	authenticated := srv.Secret != nil
+	if authenticated {
+		authID, err := srv.authenticate(conn, addr, reader)
+		if err != nil {
+			srv.log().Error("authentication failed", "remote_addr", addr, "err", err)
+			conn.Close()
+			return
+		}
+		id = authID
+		srv.log().Info("authenticated", "remote_addr", addr, "id", id)
+	}
+
 	defer func() {
 		if id != "" {
 			srv.connections.Remove(id)
 		}
-		conn.Close()                                  // закрываем соединение после любой ошибки
-		log.Printf("%s -> disconnected %q", addr, id) // выводим информацию о закрытии соединения
-		log.Println("!:", srv.connections.List())
+		conn.Close() // закрываем соединение после любой ошибки
+		srv.log().Info("disconnected", "remote_addr", addr, "id", id)
+		if debugConn {
+			srv.log().Debug("connections", "ids", srv.connections.List())
+		}
 	}()
 	// читаем команды до тех пор, пока соединение не будет закрыто
 	for {
-		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-			log.Println(addr, "ERROR:", err.Error())
+		if err := conn.SetReadDeadline(time.Now().Add(srv.readTimeout())); err != nil {
+			srv.log().Error("set read deadline failed", "remote_addr", addr, "err", err)
 			return
 		}
 		message, err := reader.ReadString('\n') // читаем команду до конца строки
 		if err != nil {
-			log.Println(addr, "ERROR:", err.Error())
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// клиент молчал дольше timeout: прежде чем рвать соединение, проверяем его
+				// пробой — это переживает временные паузы и выявляет полуоткрытые сокеты, не
+				// повышая общий таймаут для всех остальных. Проба асинхронна: reader-цикл
+				// продолжает читать conn, чтобы доставить пробе признак активности ниже — любое
+				// сообщение снимает пробу, не только PONG.
+				probe(srv, id, addr, conn, pending, &pendMu)
+				continue
+			}
+			srv.log().Error("read failed", "remote_addr", addr, "id", id, "err", err)
 			return
 		}
 		if id != "" {
 			srv.connections.Update(id) // обновляем время последней активности клиента
 		}
-		if len(message) > 256 {
+		// Любое сообщение от клиента — не только PONG — доказывает, что соединение живо: снимаем
+		// все еще не завершенные keepalive-пробы, чтобы не закрыть по таймауту пробы соединение,
+		// которое все это время исправно отвечало чем-то другим.
+		pendMu.Lock()
+		for nonce, ch := range pending {
+			select {
+			case ch <- nil:
+			default:
+			}
+			delete(pending, nonce)
+		}
+		pendMu.Unlock()
+		if len(message) > srv.maxHeaderLength() {
 			continue // игнорируем слишком длинные заголовки
 		}
-		message = strings.TrimSpace(message)  // избавляемся от лишних пробелов
-		log.Printf("%s -> %s", addr, message) // выводим информацию о запросе
+		message = strings.TrimSpace(message) // избавляемся от лишних пробелов
+		if debugCmd {
+			srv.log().Debug("recv", "remote_addr", addr, "msg", message)
+		}
 		var (
 			splits = strings.SplitN(message, " ", 2) // отделяем команду от параметров
 			cmd    = strings.ToUpper(splits[0])      // приводим команду к верхнему регистру
@@ -165,95 +803,309 @@ func (srv *Server) servConn(conn net.Conn) {
 		switch cmd {
 		case CONNECT: // подключение
 			if param != "" {
-				var addr2 string
+				var (
+					claimedID string
+					addr2     string
+				)
 				if idx := strings.IndexRune(param, ' '); idx > 1 {
-					id = param[:idx]
+					claimedID = param[:idx]
 					addr2 = param[idx:]
-					log.Printf("+ ADD 1: id - %q [%x], addr2: %q", id, id, addr2)
 				} else {
-					id = param
-					log.Printf("+ ADD 2: id - %q [%x], addr2: %q", id, id, addr2)
+					claimedID = param
+				}
+				// Если соединение уже прошло аутентификацию, id в CONNECT должен совпадать с
+				// подтвержденным в AUTH — клиент не может выдать себя за другого.
+				if authenticated && claimedID != id {
+					if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "id mismatch"); err != nil {
+						srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+						return // больше нечего делать
+					}
+					continue
 				}
+				id = claimedID
 				srv.connections.Add(conn, id, addr, addr2)
-				if err := Send(addr, conn, OK, cmd, id, addr); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, OK, cmd, id, addr); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
-				log.Println("!:", srv.connections.List())
+				srv.log().Info("connected", "remote_addr", addr, "id", id)
+				if debugConn {
+					srv.log().Debug("connections", "ids", srv.connections.List())
+				}
 			} else {
-				if err := Send(addr, conn, ERROR, cmd, "empty id"); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "empty id"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "err", err)
 					return // больше нечего делать
 				}
 			}
 		case STATUS: // изменение текста статуса
 			if id != "" {
 				srv.connections.SetStatus(id, param)
-				if err := Send(addr, conn, OK, cmd, param); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, OK, cmd, param); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 			} else {
-				if err := Send(addr, conn, ERROR, cmd, "not connected"); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "not connected"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "err", err)
 					return // больше нечего делать
 				}
 			}
 		case INFO: // запрос информации о соединении
-			// log.Printf("# INFO: %q", param)
-			if info := srv.connections.Info(param); info != nil && info.conn != nil && time.Since(info.updated) < timeout {
-				// log.Printf("# INFO: %q CONNECTED", param)
-				if err := Send(info.addr, info.conn, PING, id); err != nil {
-					log.Println(info.addr, "ERROR:", err.Error())
+			if authenticated && !srv.activeConfig().allowedTo(id, param) {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "forbidden"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			if info := srv.connections.Info(param); info != nil && info.conn != nil && time.Since(info.updated) < srv.readTimeout() {
+				if err := Send(srv.writeTimeout(), info.addr, info.conn, PING, id); err != nil {
+					srv.log().Error("peer unreachable", "cmd", cmd, "peer_id", param, "remote_addr", info.addr, "err", err)
 					srv.connections.Remove(param)
-					if err := Send(addr, conn, ERROR, cmd, param, "not found"); err != nil {
-						log.Println(addr, "ERROR:", err.Error())
+					if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "not found"); err != nil {
+						srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 						return // больше нечего делать
 					}
 					continue
 				}
-				// log.Printf("# INFO: %q CONNECTED 2", param)
-				if err := Send(addr, conn, OK, cmd, param, info.String()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				fields := []string{OK, cmd, param, info.String()}
+				if partner, ok := srv.connections.Session(param); ok {
+					fields = append(fields, "session="+partner)
+				}
+				if err := Send(srv.writeTimeout(), addr, conn, fields...); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 			} else {
-				if info == nil {
-					log.Printf("# INFO: %q NOT CONNECTED", param)
-				} else if info.conn == nil {
-					log.Printf("# INFO: %q CONNECTION IS NIL", param)
-				} else if time.Since(info.updated) >= timeout {
-					log.Printf("# INFO: %q CONNECTION TIMEOUT", param)
-				} else {
-					log.Printf("# INFO: %q CONNECTION UNKNOWN ERROR", param)
+				if debugCmd {
+					switch {
+					case info == nil:
+						srv.log().Debug("info lookup miss", "cmd", cmd, "peer_id", param, "reason", "not connected")
+					case info.conn == nil:
+						srv.log().Debug("info lookup miss", "cmd", cmd, "peer_id", param, "reason", "udp-only connection")
+					case time.Since(info.updated) >= srv.readTimeout():
+						srv.log().Debug("info lookup miss", "cmd", cmd, "peer_id", param, "reason", "timed out")
+					default:
+						srv.log().Debug("info lookup miss", "cmd", cmd, "peer_id", param, "reason", "unknown")
+					}
 				}
-				if err := Send(addr, conn, ERROR, cmd, param, "not found"); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "not found"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 			}
-			log.Printf("# INFO: %q END", param)
 		case PING: // поддержка соединения
-			if err := Send(addr, conn, OK, cmd, param); err != nil {
-				log.Println(addr, "ERROR:", err.Error())
+			if err := Send(srv.writeTimeout(), addr, conn, OK, cmd, param); err != nil {
+				srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 				return // больше нечего делать
 			}
+		case PONG: // ответ на серверную keepalive-пробу; сама проба уже снята общим обработчиком выше
 		case DISCONNECT: // закрытие соединения
-			Send(addr, conn, OK, cmd)
+			Send(srv.writeTimeout(), addr, conn, OK, cmd)
 			return // больше нечего делать
+		case SESSION: // запрос на full-duplex relay-сессию с peer_id
+			if id == "" {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "not connected"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			if param == "" {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "empty id"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			if authenticated && !srv.activeConfig().allowedTo(id, param) {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "forbidden"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			peer := srv.connections.Info(param)
+			if peer == nil || peer.conn == nil || time.Since(peer.updated) > srv.readTimeout() {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "not connected"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			req := &sessionRequest{peer: param, resp: make(chan bool, 1), ready: make(chan struct{})}
+			srv.sessionMu.Lock()
+			srv.sessionPending[id] = req
+			srv.sessionMu.Unlock()
+			if err := Send(srv.writeTimeout(), peer.addr, peer.conn, SESSION_REQUEST, id); err != nil {
+				srv.sessionMu.Lock()
+				delete(srv.sessionPending, id)
+				srv.sessionMu.Unlock()
+				srv.log().Error("session request failed", "cmd", cmd, "id", id, "peer_id", param, "err", err)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "unreachable"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			var accepted bool
+			select {
+			case accepted = <-req.resp:
+			case <-time.After(srv.sessionRequestTimeout()):
+				srv.sessionMu.Lock()
+				delete(srv.sessionPending, id)
+				srv.sessionMu.Unlock()
+				// Отменяем рандеву: если peer уже прошел SESSION_ACCEPT и ждет ready (проскочив
+				// между этим delete и своим собственным — см. granted в sessionRequest), не даем
+				// ему повиснуть в <-req.ready навсегда.
+				close(req.ready)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "timeout"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			if !accepted {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "rejected"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			sendErr := Send(srv.writeTimeout(), addr, conn, OK, cmd, param)
+			req.granted = true
+			close(req.ready) // будим peer: OK записан (или не будет записан — conn все равно рвется)
+			if sendErr != nil {
+				srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", sendErr)
+				return // больше нечего делать
+			}
+			// С этого момента чтение из reader больше не разбирается как команды: оно целиком
+			// отдано под релей байтов инициатора к peer_id, пока один из концов не вернет ошибку
+			// или EOF — тогда обе стороны рвутся каскадно через Close в своих defer. SESSION_CLOSE
+			// отменяет только еще не принятый запрос (см. ниже); активную сессию он не завершает,
+			// и команды поверх этого соединения больше не принимаются до следующего подключения.
+			conn.SetReadDeadline(time.Time{}) // во время релея общий таймаут бездействия не действует
+			srv.connections.SetSession(id, param)
+			if debugRelay {
+				srv.log().Debug("session started", "id", id, "peer_id", param)
+			}
+			_, relayErr := io.CopyBuffer(peer.conn, reader, make([]byte, srv.relayBufferSize()))
+			srv.connections.ClearSession(id)
+			srv.log().Info("session ended", "id", id, "peer_id", param, "err", relayErr)
+			return
+		case SESSION_ACCEPT: // подтверждение запроса SESSION, пришедшего как SESSION_REQUEST
+			if id == "" || param == "" {
+				continue
+			}
+			srv.sessionMu.Lock()
+			req, ok := srv.sessionPending[param]
+			if ok && req.peer != id {
+				// запрос существует, но адресован не этому id — не отдаем чужую сессию
+				ok = false
+			}
+			if ok {
+				delete(srv.sessionPending, param)
+			}
+			srv.sessionMu.Unlock()
+			if !ok {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "no such request"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			initiator := srv.connections.Info(param)
+			if initiator == nil || initiator.conn == nil {
+				select {
+				case req.resp <- false:
+				default:
+				}
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "gone"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			select {
+			case req.resp <- true:
+			default:
+			}
+			// Ждем, пока инициатор полностью допишет "OK SESSION <id>" в initiator.conn, прежде
+			// чем начинать релей в ту же сторону — иначе обе горутины пишут в один net.Conn
+			// одновременно и перемежают байты ответа и релея. ready также закрывается, если
+			// инициатор тем временем сам вышел по sessionRequestTimeout (см. case SESSION) —
+			// в этом случае granted остается false и релей не начинается.
+			<-req.ready
+			if !req.granted {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "timeout"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				continue
+			}
+			conn.SetReadDeadline(time.Time{}) // во время релея общий таймаут бездействия не действует
+			srv.connections.SetSession(id, param)
+			if debugRelay {
+				srv.log().Debug("session started", "id", id, "peer_id", param)
+			}
+			_, relayErr := io.CopyBuffer(initiator.conn, reader, make([]byte, srv.relayBufferSize()))
+			srv.connections.ClearSession(id)
+			srv.log().Info("session ended", "id", id, "peer_id", param, "err", relayErr)
+			return
+		case SESSION_REJECT: // отказ от запроса SESSION, пришедшего как SESSION_REQUEST
+			if param == "" {
+				continue
+			}
+			srv.sessionMu.Lock()
+			req, ok := srv.sessionPending[param]
+			if ok && req.peer != id {
+				ok = false
+			}
+			if ok {
+				delete(srv.sessionPending, param)
+			}
+			srv.sessionMu.Unlock()
+			if ok {
+				select {
+				case req.resp <- false:
+				default:
+				}
+			}
+		case SESSION_CLOSE: // отмена собственного еще не принятого запроса SESSION
+			srv.sessionMu.Lock()
+			req, ok := srv.sessionPending[id]
+			if ok {
+				delete(srv.sessionPending, id)
+			}
+			srv.sessionMu.Unlock()
+			if ok {
+				select {
+				case req.resp <- false:
+				default:
+				}
+			}
 		case TO:
 			if param == "" {
-				if err := Send(addr, conn, ERROR, cmd, "empty TO"); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "empty TO"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				reader.Reset(conn)
+				continue
+			}
+			if authenticated && !srv.activeConfig().allowedTo(id, param) {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "forbidden"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
 				continue
 			}
 			to := srv.connections.Info(param)
-			if to == nil || to.conn == nil || time.Since(to.updated) > timeout {
-				if err := Send(addr, conn, ERROR, cmd, param, "not connected"); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+			if to == nil || to.conn == nil || time.Since(to.updated) > srv.readTimeout() {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, param, "not connected"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
@@ -261,17 +1113,26 @@ func (srv *Server) servConn(conn net.Conn) {
 			}
 			var length int32
 			if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
-				if err := Send(addr, conn, ERROR, cmd, err.Error()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, err.Error()); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
 				continue
 			}
-			// log.Println(addr, "Length %d:", length-4)
-			if err := Send(to.addr, to.conn, "FROM", id); err != nil {
-				if err := Send(addr, conn, ERROR, cmd, err.Error()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+			if int64(length)-4 > srv.maxPayloadLength() {
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, "payload too large"); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
+					return // больше нечего делать
+				}
+				io.CopyN(io.Discard, reader, int64(length-4)) // вычитываем и отбрасываем лишнее
+				reader.Reset(conn)
+				continue
+			}
+			if err := Send(srv.writeTimeout(), to.addr, to.conn, "FROM", id); err != nil {
+				srv.log().Error("relay failed", "cmd", cmd, "id", id, "peer_id", param, "err", err)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, err.Error()); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
@@ -279,18 +1140,19 @@ func (srv *Server) servConn(conn net.Conn) {
 				continue
 			}
 			if err := binary.Write(to.conn, binary.LittleEndian, length); err != nil {
-				if err := Send(addr, conn, ERROR, cmd, err.Error()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				srv.log().Error("relay failed", "cmd", cmd, "id", id, "peer_id", param, "err", err)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, err.Error()); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
 				srv.connections.Remove(param)
 				continue
 			}
-			if err := to.conn.SetWriteDeadline(time.Now().Add(30 * time.Second)); err != nil {
-				log.Println(addr, "ERROR Write Deadline:", err.Error())
-				if err := Send(addr, conn, ERROR, cmd, err.Error()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+			if err := to.conn.SetWriteDeadline(time.Now().Add(srv.relayTimeout())); err != nil {
+				srv.log().Error("relay failed", "cmd", cmd, "id", id, "peer_id", param, "err", err)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, err.Error()); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
@@ -298,17 +1160,20 @@ func (srv *Server) servConn(conn net.Conn) {
 				continue
 			}
 			if n, err := io.CopyN(to.conn, reader, int64(length-4)); err != nil {
-				if err := Send(addr, conn, ERROR, cmd, err.Error()); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				srv.log().Error("relay failed", "cmd", cmd, "id", id, "peer_id", param, "err", err)
+				if err := Send(srv.writeTimeout(), addr, conn, ERROR, cmd, err.Error()); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 				reader.Reset(conn)
 				srv.connections.Remove(param)
 				continue
 			} else {
-				log.Printf("transform from %q to %q completed [%d]", id, param, n)
-				if err := Send(addr, conn, OK, cmd, param); err != nil {
-					log.Println(addr, "ERROR:", err.Error())
+				if debugRelay {
+					srv.log().Debug("relayed", "cmd", cmd, "id", id, "peer_id", param, "bytes", n)
+				}
+				if err := Send(srv.writeTimeout(), addr, conn, OK, cmd, param); err != nil {
+					srv.log().Error("send failed", "cmd", cmd, "remote_addr", addr, "id", id, "err", err)
 					return // больше нечего делать
 				}
 			}